@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"path"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/julienschmidt/httprouter"
@@ -41,7 +46,9 @@ type operationContext struct {
 }
 
 type oidcContext struct {
-	AWS *awsOIDCContext `json:"aws,omitempty"`
+	AWS   *awsOIDCContext   `json:"aws,omitempty"`
+	Azure *azureOIDCContext `json:"azure,omitempty"`
+	GCP   *gcpOIDCContext   `json:"gcp,omitempty"`
 }
 
 type awsOIDCContext struct {
@@ -49,6 +56,18 @@ type awsOIDCContext struct {
 	SessionName string `json:"sessionName,omitempty"`
 }
 
+type azureOIDCContext struct {
+	ClientID       string `json:"clientId,omitempty"`
+	TenantID       string `json:"tenantId,omitempty"`
+	SubscriptionID string `json:"subscriptionId,omitempty"`
+}
+
+type gcpOIDCContext struct {
+	WorkloadPoolID string `json:"workloadPoolId,omitempty"`
+	ProviderID     string `json:"providerId,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+}
+
 type gitHubContext struct {
 	Repository          string   `json:"repository,omitempty"`
 	Paths               []string `json:"paths,omitempty"`
@@ -63,6 +82,10 @@ type createDeploymentRequest struct {
 	Operation       string `json:"operation"`
 }
 
+type createDeploymentResponse struct {
+	ID string `json:"id"`
+}
+
 type createStackRequest struct {
 	StackName string `json:"stackName"`
 }
@@ -86,12 +109,25 @@ type getUserResponse struct {
 }
 
 type createSiteRequest struct {
-	ID      string `json:"id"`
-	Content string `json:"content"`
+	ID        string `json:"id"`
+	Template  string `json:"template"`
+	Content   string `json:"content"`
+	CommitSHA string `json:"commitSha,omitempty"`
 }
 
 type updateSiteRequest struct {
-	Content string `json:"content"`
+	Content   string `json:"content"`
+	CommitSHA string `json:"commitSha,omitempty"`
+}
+
+// createPreviewRequest carries the pull request that a review environment
+// is being created for. The child stack is deployed from the PR's head
+// branch rather than the parent stack's branch, once, when it is created;
+// its settings turn off deploying on pushed commits.
+type createPreviewRequest struct {
+	PRNumber int    `json:"prNumber"`
+	HeadRef  string `json:"headRef"`
+	HeadSHA  string `json:"headSha,omitempty"`
 }
 
 type getSiteResponse struct {
@@ -100,6 +136,216 @@ type getSiteResponse struct {
 	Status string `json:"status,omitempty"`
 }
 
+// deploymentUpdatesResponse mirrors the subset of the Pulumi service's
+// `/deployments/{id}/updates` response that the events endpoint cares about.
+type deploymentUpdatesResponse struct {
+	Updates []resourceUpdate `json:"updates"`
+}
+
+type resourceUpdate struct {
+	Type   string `json:"type"`
+	URN    string `json:"urn"`
+	Status string `json:"status"`
+}
+
+// deploymentLogsResponse mirrors the subset of the Pulumi service's
+// `/deployments/{id}/logs` response that the events endpoint cares about.
+type deploymentLogsResponse struct {
+	Lines     []logLine `json:"lines"`
+	NextToken string    `json:"nextToken,omitempty"`
+}
+
+type logLine struct {
+	Timestamp int64  `json:"timestamp"`
+	Line      string `json:"line"`
+}
+
+type deploymentStatusResponse struct {
+	Status string `json:"status"`
+}
+
+type createGitHubDeploymentRequest struct {
+	Ref              string   `json:"ref"`
+	Environment      string   `json:"environment"`
+	AutoMerge        bool     `json:"auto_merge"`
+	RequiredContexts []string `json:"required_contexts"`
+}
+
+type createGitHubDeploymentResponse struct {
+	ID int64 `json:"id"`
+}
+
+type createGitHubDeploymentStatusRequest struct {
+	State          string `json:"state"`
+	EnvironmentURL string `json:"environment_url,omitempty"`
+}
+
+const githubAPIURL = "https://api.github.com"
+
+// githubReporter mirrors an in-flight Pulumi deployment as a GitHub
+// Deployment, transitioning its status as the deployment progresses so the
+// triggering commit shows a proper environment badge.
+type githubReporter struct {
+	client *resty.Client
+	token  string
+}
+
+func newGitHubReporter(token string) *githubReporter {
+	return &githubReporter{client: resty.New(), token: token}
+}
+
+func (g *githubReporter) createDeployment(ctx context.Context, repo, sha, environment string) (int64, error) {
+	resp, err := g.client.R().
+		SetContext(ctx).
+		SetBody(createGitHubDeploymentRequest{
+			Ref:              sha,
+			Environment:      environment,
+			AutoMerge:        false,
+			RequiredContexts: []string{},
+		}).
+		SetHeader("Authorization", "token "+g.token).
+		SetHeader("Accept", "application/vnd.github+json").
+		Post(githubAPIURL + path.Join("/repos", repo, "deployments"))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode() != 201 {
+		return 0, errors.New(string(resp.Body()))
+	}
+	var created createGitHubDeploymentResponse
+	if err := json.Unmarshal(resp.Body(), &created); err != nil {
+		return 0, fmt.Errorf("decoding deployment response: %w", err)
+	}
+	return created.ID, nil
+}
+
+func (g *githubReporter) setStatus(ctx context.Context, repo string, deploymentID int64, state, environmentURL string) error {
+	resp, err := g.client.R().
+		SetContext(ctx).
+		SetBody(createGitHubDeploymentStatusRequest{
+			State:          state,
+			EnvironmentURL: environmentURL,
+		}).
+		SetHeader("Authorization", "token "+g.token).
+		SetHeader("Accept", "application/vnd.github+json").
+		Post(githubAPIURL + path.Join("/repos", repo, "deployments", fmt.Sprintf("%d", deploymentID), "statuses"))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != 201 {
+		return errors.New(string(resp.Body()))
+	}
+	return nil
+}
+
+// apiErrorEnvelope mirrors the Pulumi service's JSON error shape.
+type apiErrorEnvelope struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// APIError is a decoded error response from the Pulumi service API.
+type APIError struct {
+	StatusCode int
+	Code       int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("pulumi API error (http %d): %s", e.StatusCode, e.Message)
+}
+
+// pulumiClient wraps resty.Client with the retry/backoff and error-decoding
+// behavior every call into the Pulumi service needs: idempotent GETs are
+// retried on a 429/5xx response or on a connection failure, with exponential
+// backoff and jitter honoring a Retry-After header when the service sends
+// one; non-idempotent requests are never retried, since the service may have
+// already processed them, and non-2xx responses are decoded into an
+// *APIError instead of being stringified.
+type pulumiClient struct {
+	*resty.Client
+}
+
+func newPulumiClient(apiToken string) *pulumiClient {
+	restyClient := resty.New().
+		SetHeader("Authorization", "token "+apiToken).
+		SetHeader("Accept", "application/json").
+		SetRetryCount(6).
+		SetRetryWaitTime(500 * time.Millisecond).
+		SetRetryMaxWaitTime(30 * time.Second).
+		AddRetryCondition(func(resp *resty.Response, err error) bool {
+			if resp == nil || resp.Request.Method != resty.MethodGet {
+				return false
+			}
+			// err != nil also covers connection-level failures where no
+			// response was received at all. Non-GET requests are never
+			// retried here, since the service may have already processed
+			// them - retrying risks starting a second real deployment.
+			if resp.StatusCode() == http.StatusTooManyRequests || resp.StatusCode() >= 500 {
+				return true
+			}
+			return err != nil
+		}).
+		SetRetryAfter(func(_ *resty.Client, resp *resty.Response) (time.Duration, error) {
+			if after := resp.Header().Get("Retry-After"); after != "" {
+				if seconds, err := strconv.Atoi(after); err == nil {
+					return time.Duration(seconds) * time.Second, nil
+				}
+			}
+			return 0, nil
+		})
+	return &pulumiClient{Client: restyClient}
+}
+
+// checkStatus returns nil if resp's status code is one of accepted, and
+// otherwise decodes the Pulumi service's error envelope into an *APIError.
+func (c *pulumiClient) checkStatus(resp *resty.Response, accepted ...int) error {
+	for _, code := range accepted {
+		if resp.StatusCode() == code {
+			return nil
+		}
+	}
+	var envelope apiErrorEnvelope
+	if err := json.Unmarshal(resp.Body(), &envelope); err != nil || envelope.Message == "" {
+		return &APIError{StatusCode: resp.StatusCode(), Message: string(resp.Body())}
+	}
+	return &APIError{StatusCode: resp.StatusCode(), Code: envelope.Code, Message: envelope.Message}
+}
+
+// writeError maps err to an HTTP response, forwarding the Pulumi service's
+// own 401/403/404/409 to the site client rather than collapsing everything
+// into a 500.
+func writeError(w http.ResponseWriter, context string, err error) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusConflict:
+			w.WriteHeader(apiErr.StatusCode)
+			fmt.Fprintf(w, "%s: %s", context, apiErr.Message)
+			log.Printf("%s: %v", context, err)
+			return
+		}
+	}
+	internalServerError(w, fmt.Errorf("%s: %w", context, err))
+}
+
+// requireAdminToken wraps h so that it only runs for requests presenting
+// token as a bearer token, guarding admin endpoints - like template
+// registration - that hand out a tenant's repository and cloud identity to
+// whoever calls them. It's a shared-secret check meant for a demo fronted by
+// a private network or reverse proxy, not a substitute for per-tenant auth.
+func requireAdminToken(token string, h httprouter.Handle) httprouter.Handle {
+	expected := []byte("Bearer " + token)
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "missing or invalid admin token")
+			return
+		}
+		h(w, r, p)
+	}
+}
+
 func internalServerError(w http.ResponseWriter, err error) {
 	w.WriteHeader(500)
 	fmt.Fprintf(w, "Internal Server Error")
@@ -107,21 +353,337 @@ func internalServerError(w http.ResponseWriter, err error) {
 }
 
 type siteServer struct {
-	client *resty.Client
+	client *pulumiClient
 
-	repository string
-	branch     string
-	dir        string
+	templates templateStore
 
-	roleARN     string
-	sessionName string
+	github *githubReporter
 
-	apiToken string
-	org      string
-	project  string
+	org     string
+	project string
+
+	sites siteStore // site ID -> template name, so previews can inherit the parent's template
+
+	followersMu sync.Mutex
+	followers   map[string]*deploymentFollower // site ID -> in-flight deployment follower
+}
+
+// recordSite remembers which template a site was created from, so that
+// later requests for the site - most notably previews - can inherit its
+// repository, OIDC, and environment defaults without the caller repeating
+// them, even across a restart.
+func (s *siteServer) recordSite(id, template string) error {
+	return s.sites.put(id, template)
+}
+
+// templateForSite returns the template a site was created from, if any.
+func (s *siteServer) templateForSite(id string) (*siteTemplate, bool) {
+	name, ok := s.sites.get(id)
+	if !ok {
+		return nil, false
+	}
+	return s.templates.get(name)
+}
+
+// awsOIDCConfig carries the operator-configured AWS OIDC settings used to
+// populate operationContext.OIDC.AWS and the AWS_REGION environment variable.
+type awsOIDCConfig struct {
+	RoleARN     string `json:"roleArn"`
+	SessionName string `json:"sessionName"`
+	Region      string `json:"region"`
+}
+
+// azureOIDCConfig carries the operator-configured Azure OIDC settings used to
+// populate operationContext.OIDC.Azure.
+type azureOIDCConfig struct {
+	ClientID       string `json:"clientId"`
+	TenantID       string `json:"tenantId"`
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// gcpOIDCConfig carries the operator-configured GCP OIDC settings used to
+// populate operationContext.OIDC.GCP.
+type gcpOIDCConfig struct {
+	WorkloadPoolID string `json:"workloadPoolId"`
+	ProviderID     string `json:"providerId"`
+	ServiceAccount string `json:"serviceAccount"`
+}
+
+// siteTemplate carries the per-tenant defaults that used to live in process-
+// global flags: which repository and branch to deploy, which OIDC providers
+// to assume, and which environment variables to set. Every site is created
+// from exactly one named template, which lets a single server front many
+// Pulumi programs across many tenants.
+type siteTemplate struct {
+	Name       string            `json:"name"`
+	Repository string            `json:"repository"`
+	Branch     string            `json:"branch"`
+	Dir        string            `json:"dir,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+
+	AWS   *awsOIDCConfig   `json:"aws,omitempty"`
+	Azure *azureOIDCConfig `json:"azure,omitempty"`
+	GCP   *gcpOIDCConfig   `json:"gcp,omitempty"`
+}
+
+// oidc builds the OIDC block for the deployment settings from whichever
+// providers the template configured. More than one provider may be
+// configured on the same stack.
+func (t *siteTemplate) oidc() *oidcContext {
+	oidc := &oidcContext{}
+	if t.AWS != nil {
+		oidc.AWS = &awsOIDCContext{
+			RoleARN:     t.AWS.RoleARN,
+			SessionName: t.AWS.SessionName,
+		}
+	}
+	if t.Azure != nil {
+		oidc.Azure = &azureOIDCContext{
+			ClientID:       t.Azure.ClientID,
+			TenantID:       t.Azure.TenantID,
+			SubscriptionID: t.Azure.SubscriptionID,
+		}
+	}
+	if t.GCP != nil {
+		oidc.GCP = &gcpOIDCContext{
+			WorkloadPoolID: t.GCP.WorkloadPoolID,
+			ProviderID:     t.GCP.ProviderID,
+			ServiceAccount: t.GCP.ServiceAccount,
+		}
+	}
+	if oidc.AWS == nil && oidc.Azure == nil && oidc.GCP == nil {
+		return nil
+	}
+	return oidc
+}
+
+// oidcEnvironment returns the environment variables the template's
+// configured OIDC providers expect their SDKs to find (e.g. AWS_REGION),
+// layered on top of the template's own environment variable defaults.
+func (t *siteTemplate) oidcEnvironment() map[string]string {
+	env := make(map[string]string, len(t.Env))
+	for k, v := range t.Env {
+		env[k] = v
+	}
+	if t.AWS != nil {
+		env["AWS_REGION"] = t.AWS.Region
+	}
+	return env
 }
 
-func (s *siteServer) updateStack(ctx context.Context, stack, content string) error {
+// templateStore persists the registry of site templates, keyed by name, so
+// that it survives server restarts.
+type templateStore interface {
+	get(name string) (*siteTemplate, bool)
+	put(t *siteTemplate) error
+}
+
+// memoryTemplateStore is a templateStore with no backing storage; templates
+// registered with it do not survive a restart.
+type memoryTemplateStore struct {
+	mu        sync.Mutex
+	templates map[string]*siteTemplate
+}
+
+func newMemoryTemplateStore() *memoryTemplateStore {
+	return &memoryTemplateStore{templates: make(map[string]*siteTemplate)}
+}
+
+func (s *memoryTemplateStore) get(name string) (*siteTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+func (s *memoryTemplateStore) put(t *siteTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates[t.Name] = t
+	return nil
+}
+
+// fileTemplateStore is a templateStore backed by a JSON file on disk. The
+// file is read once at startup and rewritten in full on every put, so the
+// registry survives a restart without requiring an external database.
+type fileTemplateStore struct {
+	path string
+
+	mu        sync.Mutex
+	templates map[string]*siteTemplate
+}
+
+func newFileTemplateStore(path string) (*fileTemplateStore, error) {
+	s := &fileTemplateStore{path: path, templates: make(map[string]*siteTemplate)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.templates); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileTemplateStore) get(name string) (*siteTemplate, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.templates[name]
+	return t, ok
+}
+
+func (s *fileTemplateStore) put(t *siteTemplate) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.templates[t.Name] = t
+
+	data, err := json.MarshalIndent(s.templates, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o644)
+}
+
+// newTemplateStore opens the templateStore backing path, or falls back to an
+// in-memory store if path is empty.
+func newTemplateStore(path string) (templateStore, error) {
+	if path == "" {
+		return newMemoryTemplateStore(), nil
+	}
+	return newFileTemplateStore(path)
+}
+
+// siteStore persists the site ID -> template name associations recorded by
+// recordSite, so that templateForSite keeps resolving previews and GitHub
+// status reporting to the right template across a restart.
+type siteStore interface {
+	get(id string) (string, bool)
+	put(id, template string) error
+}
+
+// memorySiteStore is a siteStore with no backing storage; associations
+// recorded with it do not survive a restart.
+type memorySiteStore struct {
+	mu    sync.Mutex
+	sites map[string]string
+}
+
+func newMemorySiteStore() *memorySiteStore {
+	return &memorySiteStore{sites: make(map[string]string)}
+}
+
+func (s *memorySiteStore) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.sites[id]
+	return name, ok
+}
+
+func (s *memorySiteStore) put(id, template string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sites[id] = template
+	return nil
+}
+
+// fileSiteStore is a siteStore backed by a JSON file on disk, read once at
+// startup and rewritten in full on every put, following the same pattern as
+// fileTemplateStore.
+type fileSiteStore struct {
+	path string
+
+	mu    sync.Mutex
+	sites map[string]string
+}
+
+func newFileSiteStore(path string) (*fileSiteStore, error) {
+	s := &fileSiteStore{path: path, sites: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.sites); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (s *fileSiteStore) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, ok := s.sites[id]
+	return name, ok
+}
+
+func (s *fileSiteStore) put(id, template string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sites[id] = template
+
+	data, err := json.MarshalIndent(s.sites, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0o644)
+}
+
+// newSiteStore opens the siteStore backing path, or falls back to an
+// in-memory store if path is empty.
+func newSiteStore(path string) (siteStore, error) {
+	if path == "" {
+		return newMemorySiteStore(), nil
+	}
+	return newFileSiteStore(path)
+}
+
+// startFollower begins following an in-flight deployment in the background,
+// reporting its progress to GitHub (if configured) and to any SSE
+// subscribers, until it reaches a terminal state.
+func (s *siteServer) startFollower(site, deploymentID, commitSHA string) {
+	f := &deploymentFollower{
+		server:       s,
+		site:         site,
+		deploymentID: deploymentID,
+		commitSHA:    commitSHA,
+		subs:         make(map[int]chan []byte),
+	}
+	s.followersMu.Lock()
+	s.followers[site] = f
+	s.followersMu.Unlock()
+	go f.run()
+}
+
+// removeFollower removes f from the followers map, but only if it is still
+// the follower registered for site. A second deployment started for the
+// same site (e.g. a redeploy fired while the first was still running)
+// replaces f in the map with a newer follower before f finishes; removing
+// unconditionally would then drop the newer, still in-flight follower and
+// leave GET /sites/:id/events 404ing for a deployment that is actually
+// running.
+func (s *siteServer) removeFollower(site string, f *deploymentFollower) {
+	s.followersMu.Lock()
+	defer s.followersMu.Unlock()
+	if s.followers[site] == f {
+		delete(s.followers, site)
+	}
+}
+
+func (s *siteServer) follower(site string) (*deploymentFollower, bool) {
+	s.followersMu.Lock()
+	defer s.followersMu.Unlock()
+	f, ok := s.followers[site]
+	return f, ok
+}
+
+func (s *siteServer) updateStack(ctx context.Context, stack, content, commitSHA string) (string, error) {
 	resp, err := s.client.R().
 		SetContext(ctx).
 		SetBody(createDeploymentRequest{
@@ -135,16 +697,20 @@ func (s *siteServer) updateStack(ctx context.Context, stack, content string) err
 			InheritSettings: true,
 			Operation:       "update",
 		}).
-		SetHeader("Authorization", "token "+s.apiToken).
-		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployments"))
 	if err != nil {
-		return err
+		return "", err
 	}
-	if resp.StatusCode() != http.StatusAccepted {
-		return errors.New(string(resp.Body()))
+	if err := s.client.checkStatus(resp, http.StatusAccepted); err != nil {
+		return "", err
 	}
-	return nil
+
+	var created createDeploymentResponse
+	if err := json.Unmarshal(resp.Body(), &created); err != nil {
+		return "", fmt.Errorf("decoding deployment response: %w", err)
+	}
+	s.startFollower(stack, created.ID, commitSHA)
+	return created.ID, nil
 }
 
 func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -155,49 +721,49 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 		return
 	}
 
-	stack := create.ID
+	template, ok := s.templates.get(create.Template)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "unknown template %q", create.Template)
+		return
+	}
+
+	// Namespace the stack name by template so that sites with the same ID
+	// created from different templates - different tenants - can't collide.
+	stack := fmt.Sprintf("%s-%s", template.Name, create.ID)
 
 	resp, err := s.client.R().
 		SetContext(r.Context()).
 		SetBody(createStackRequest{StackName: stack}).
-		SetHeader("Authorization", "token "+s.apiToken).
-		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/stacks", s.org, s.project))
 	if err != nil {
-		internalServerError(w, fmt.Errorf("creating stack: %w", err))
+		writeError(w, "creating stack", err)
 		return
 	}
-	if resp.StatusCode() != 200 && resp.StatusCode() != 409 {
-		internalServerError(w, fmt.Errorf("creating stack: %s", string(resp.Body())))
+	if err := s.client.checkStatus(resp, 200, 409); err != nil {
+		writeError(w, "creating stack", err)
 		return
 	}
-	log.Printf("created stack '%s/%s/%s'", s.org, s.project, stack)
+	log.Printf("created stack '%s/%s/%s' from template %q", s.org, s.project, stack, template.Name)
 
 	var paths []string
-	if s.dir != "" {
-		paths = []string{s.dir + "/**"}
+	if template.Dir != "" {
+		paths = []string{template.Dir + "/**"}
 	}
 
 	settings := DeploymentSettings{
 		SourceContext: &sourceContext{
 			Git: gitContext{
-				Branch:  s.branch,
-				RepoDir: s.dir,
+				Branch:  template.Branch,
+				RepoDir: template.Dir,
 			},
 		},
 		OperationContext: &operationContext{
-			Environment: map[string]string{
-				"AWS_REGION": "us-west-2",
-			},
-			OIDC: &oidcContext{
-				AWS: &awsOIDCContext{
-					RoleARN:     s.roleARN,
-					SessionName: s.sessionName,
-				},
-			},
+			Environment: template.oidcEnvironment(),
+			OIDC:        template.oidc(),
 		},
 		GitHub: &gitHubContext{
-			Repository:          s.repository,
+			Repository:          template.Repository,
 			Paths:               paths,
 			DeployCommits:       true,
 			PreviewPullRequests: false,
@@ -206,20 +772,22 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 	resp, err = s.client.R().
 		SetContext(r.Context()).
 		SetBody(settings).
-		SetHeader("Authorization", "token "+s.apiToken).
-		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployment", "settings"))
 	if err != nil {
-		internalServerError(w, fmt.Errorf("configuring deployment: %w", err))
+		writeError(w, "configuring deployment", err)
 		return
 	}
-	if resp.StatusCode() != 200 {
-		internalServerError(w, fmt.Errorf("configuring deployment: %s", string(resp.Body())))
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		writeError(w, "configuring deployment", err)
+		return
+	}
+	if err := s.recordSite(stack, template.Name); err != nil {
+		writeError(w, "recording site", err)
 		return
 	}
 
-	if err := s.updateStack(r.Context(), stack, create.Content); err != nil {
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+	if _, err := s.updateStack(r.Context(), stack, create.Content, create.CommitSHA); err != nil {
+		writeError(w, "starting deployment", err)
 		return
 	}
 
@@ -229,32 +797,102 @@ func (s *siteServer) create(w http.ResponseWriter, r *http.Request, _ httprouter
 	}
 }
 
+// createTemplate registers or replaces a named site template in the
+// registry. Sites are always created from a template, which is what lets a
+// single server front many Pulumi programs across many tenants.
+func (s *siteServer) createTemplate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var template siteTemplate
+	if err := json.NewDecoder(r.Body).Decode(&template); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "failed to parse template request")
+		return
+	}
+	if template.Name == "" || template.Repository == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "name and repository are required")
+		return
+	}
+	if template.Branch == "" {
+		template.Branch = "main"
+	}
+	if template.AWS == nil && template.Azure == nil && template.GCP == nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "at least one of aws, azure, or gcp OIDC configuration is required")
+		return
+	}
+
+	if err := s.templates.put(&template); err != nil {
+		writeError(w, "saving template", err)
+		return
+	}
+	log.Printf("registered template %q for repository %q", template.Name, template.Repository)
+	w.WriteHeader(http.StatusOK)
+}
+
+// websiteURL fetches the stack's latest deployment export and returns its
+// `websiteUrl` stack output, if any.
+func (s *siteServer) websiteURL(ctx context.Context, id string) (string, error) {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		Get(pulumiURL + path.Join("/stacks", s.org, s.project, id, "export"))
+	if err != nil {
+		return "", err
+	}
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		return "", err
+	}
+
+	var respBody apitype.UntypedDeployment
+	if err := json.Unmarshal(resp.Body(), &respBody); err != nil {
+		return "", err
+	}
+	if respBody.Version != apitype.DeploymentSchemaVersionCurrent {
+		return "", nil
+	}
+	var stack apitype.DeploymentV3
+	if err = json.Unmarshal([]byte(respBody.Deployment), &stack); err != nil {
+		return "", fmt.Errorf("unmarshaling deployment: %w", err)
+	}
+	var stackResource *apitype.ResourceV3
+	for _, r := range stack.Resources {
+		if r.Type == "pulumi:pulumi:Stack" {
+			stackResource = &r
+			break
+		}
+	}
+	if stackResource == nil {
+		return "", nil
+	}
+	url, _ := stackResource.Outputs["websiteUrl"].(string)
+	return url, nil
+}
+
 func (s *siteServer) get(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	id := params.ByName("id")
+	s.getStack(w, r, params.ByName("id"))
+}
 
+// getStack writes the current status and website URL of the named stack.
+// It backs both the get and getPreview handlers.
+func (s *siteServer) getStack(w http.ResponseWriter, r *http.Request, id string) {
 	operation, err := func() (*operationStatus, error) {
 		resp, err := s.client.R().
 			SetContext(r.Context()).
-			SetHeader("Authorization", "token "+s.apiToken).
-			SetHeader("Accept", "application/json").
-			SetDoNotParseResponse(true).
 			Get(pulumiURL + path.Join("/stacks", s.org, s.project, id))
 		if err != nil {
 			return nil, err
 		}
-		if resp.StatusCode() != 200 {
-			return nil, errors.New(string(resp.Body()))
+		if err := s.client.checkStatus(resp, 200); err != nil {
+			return nil, err
 		}
-		defer resp.RawBody().Close()
 
 		var respBody getStackResponse
-		if err = json.NewDecoder(resp.RawBody()).Decode(&respBody); err != nil {
+		if err := json.Unmarshal(resp.Body(), &respBody); err != nil {
 			return nil, err
 		}
 		return respBody.CurrentOperation, nil
 	}()
 	if err != nil {
-		internalServerError(w, fmt.Errorf("getting stack: %w", err))
+		writeError(w, "getting stack", err)
 		return
 	}
 	status := "IDLE"
@@ -266,49 +904,11 @@ func (s *siteServer) get(w http.ResponseWriter, r *http.Request, params httprout
 		}
 	}
 
-	outputs, err := func() (map[string]interface{}, error) {
-		resp, err := s.client.R().
-			SetContext(r.Context()).
-			SetHeader("Authorization", "token "+s.apiToken).
-			SetHeader("Accept", "application/json").
-			SetDoNotParseResponse(true).
-			Get(pulumiURL + path.Join("/stacks", s.org, s.project, id, "export"))
-		if err != nil {
-			return nil, err
-		}
-		if resp.StatusCode() != 200 {
-			return nil, errors.New(string(resp.Body()))
-		}
-		defer resp.RawBody().Close()
-
-		var respBody apitype.UntypedDeployment
-		if err = json.NewDecoder(resp.RawBody()).Decode(&respBody); err != nil {
-			return nil, err
-		}
-		if respBody.Version != apitype.DeploymentSchemaVersionCurrent {
-			return nil, nil
-		}
-		var stack apitype.DeploymentV3
-		if err = json.Unmarshal([]byte(respBody.Deployment), &stack); err != nil {
-			return nil, fmt.Errorf("unmarshaling deployment: %w", err)
-		}
-		var stackResource *apitype.ResourceV3
-		for _, r := range stack.Resources {
-			if r.Type == "pulumi:pulumi:Stack" {
-				stackResource = &r
-				break
-			}
-		}
-		if stackResource == nil {
-			return nil, nil
-		}
-		return stackResource.Outputs, nil
-	}()
+	url, err := s.websiteURL(r.Context(), id)
 	if err != nil {
-		internalServerError(w, fmt.Errorf("getting stack outputs: %w", err))
+		writeError(w, "getting stack outputs", err)
 		return
 	}
-	url, _ := outputs["websiteUrl"].(string)
 
 	resp := getSiteResponse{
 		ID:     id,
@@ -330,8 +930,8 @@ func (s *siteServer) update(w http.ResponseWriter, r *http.Request, params httpr
 		return
 	}
 
-	if err := s.updateStack(r.Context(), id, update.Content); err != nil {
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+	if _, err := s.updateStack(r.Context(), id, update.Content, update.CommitSHA); err != nil {
+		writeError(w, "starting deployment", err)
 		return
 	}
 
@@ -339,72 +939,464 @@ func (s *siteServer) update(w http.ResponseWriter, r *http.Request, params httpr
 }
 
 func (s *siteServer) delete(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	id := params.ByName("id")
+	s.destroyStack(w, r, params.ByName("id"))
+}
 
+// destroyStack starts a destroy deployment for the named stack. It backs
+// both the delete and deletePreview handlers.
+func (s *siteServer) destroyStack(w http.ResponseWriter, r *http.Request, id string) {
 	resp, err := s.client.R().
 		SetContext(r.Context()).
 		SetBody(createDeploymentRequest{
 			InheritSettings: true,
 			Operation:       "destroy",
 		}).
-		SetHeader("Authorization", "token "+s.apiToken).
-		SetHeader("Accept", "application/json").
 		Post(pulumiURL + path.Join("/preview", s.org, s.project, id, "deployments"))
 	if err != nil {
-		internalServerError(w, fmt.Errorf("starting deployment: %w", err))
+		writeError(w, "starting deployment", err)
 		return
 	}
-	if resp.StatusCode() != http.StatusAccepted {
-		internalServerError(w, fmt.Errorf("starting deployment: %s", string(resp.Body())))
+	if err := s.client.checkStatus(resp, http.StatusAccepted); err != nil {
+		writeError(w, "starting deployment", err)
 		return
 	}
+
+	var created createDeploymentResponse
+	if err := json.Unmarshal(resp.Body(), &created); err == nil && created.ID != "" {
+		s.startFollower(id, created.ID, "")
+	}
+
 	w.WriteHeader(http.StatusAccepted)
 }
 
+// previewStackName derives the name of the review-environment stack created
+// for a pull request from its parent site and PR number.
+func previewStackName(parent string, prNumber int) string {
+	return fmt.Sprintf("%s-pr-%d", parent, prNumber)
+}
+
+// createPreview creates a review-environment stack for a pull request,
+// derived from the parent site's stack. Unlike the parent, the preview
+// stack's source is the PR's head branch, and its deployment settings turn
+// on pull request previews and turn off deploying on pushed commits. The
+// stack is deployed once, here, when it is created.
+func (s *siteServer) createPreview(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	parent := params.ByName("id")
+
+	template, ok := s.templateForSite(parent)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "unknown site %q", parent)
+		return
+	}
+
+	var preview createPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&preview); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "failed to parse preview request")
+		return
+	}
+	if preview.PRNumber == 0 || preview.HeadRef == "" {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "prNumber and headRef are required")
+		return
+	}
+
+	stack := previewStackName(parent, preview.PRNumber)
+
+	resp, err := s.client.R().
+		SetContext(r.Context()).
+		SetBody(createStackRequest{StackName: stack}).
+		Post(pulumiURL + path.Join("/stacks", s.org, s.project))
+	if err != nil {
+		writeError(w, "creating preview stack", err)
+		return
+	}
+	if err := s.client.checkStatus(resp, 200, 409); err != nil {
+		writeError(w, "creating preview stack", err)
+		return
+	}
+	log.Printf("created preview stack '%s/%s/%s' for PR #%d", s.org, s.project, stack, preview.PRNumber)
+
+	var paths []string
+	if template.Dir != "" {
+		paths = []string{template.Dir + "/**"}
+	}
+
+	settings := DeploymentSettings{
+		SourceContext: &sourceContext{
+			Git: gitContext{
+				Branch:  preview.HeadRef,
+				RepoDir: template.Dir,
+			},
+		},
+		OperationContext: &operationContext{
+			Environment: template.oidcEnvironment(),
+			OIDC:        template.oidc(),
+		},
+		GitHub: &gitHubContext{
+			Repository:          template.Repository,
+			Paths:               paths,
+			DeployCommits:       false,
+			PreviewPullRequests: true,
+		},
+	}
+	resp, err = s.client.R().
+		SetContext(r.Context()).
+		SetBody(settings).
+		Post(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployment", "settings"))
+	if err != nil {
+		writeError(w, "configuring preview deployment", err)
+		return
+	}
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		writeError(w, "configuring preview deployment", err)
+		return
+	}
+	if err := s.recordSite(stack, template.Name); err != nil {
+		writeError(w, "recording site", err)
+		return
+	}
+
+	if _, err := s.updateStack(r.Context(), stack, "", preview.HeadSHA); err != nil {
+		writeError(w, "starting preview deployment", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(&getSiteResponse{ID: stack}); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+func (s *siteServer) getPreview(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	prNumber, err := strconv.Atoi(params.ByName("pr"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "invalid pull request number")
+		return
+	}
+	s.getStack(w, r, previewStackName(params.ByName("id"), prNumber))
+}
+
+func (s *siteServer) deletePreview(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	prNumber, err := strconv.Atoi(params.ByName("pr"))
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "invalid pull request number")
+		return
+	}
+	s.destroyStack(w, r, previewStackName(params.ByName("id"), prNumber))
+}
+
+// events opens a Server-Sent Events stream that forwards the update and log
+// events of the site's in-flight deployment, if any, as they arrive. It is
+// just one subscriber of the deploymentFollower that is already polling the
+// deployment on behalf of the GitHub status reporter.
+func (s *siteServer) events(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	id := params.ByName("id")
+
+	f, ok := s.follower(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "no in-flight deployment for site %q", id)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalServerError(w, errors.New("streaming not supported"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	subID, frames := f.subscribe()
+	defer f.unsubscribe(subID)
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-frames:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// deploymentFollower polls a single in-flight deployment's updates, logs,
+// and status on a shared interval, fanning the results out to any SSE
+// subscribers and to the GitHub status reporter (if configured), until the
+// deployment reaches a terminal state.
+type deploymentFollower struct {
+	server       *siteServer
+	site         string
+	deploymentID string
+	commitSHA    string
+
+	mu   sync.Mutex
+	subs map[int]chan []byte
+	next int
+}
+
+func (f *deploymentFollower) subscribe() (int, <-chan []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.next
+	f.next++
+	ch := make(chan []byte, 16)
+	f.subs[id] = ch
+	return id, ch
+}
+
+func (f *deploymentFollower) unsubscribe(id int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ch, ok := f.subs[id]; ok {
+		delete(f.subs, id)
+		close(ch)
+	}
+}
+
+func (f *deploymentFollower) send(frame []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range f.subs {
+		select {
+		case ch <- frame:
+		default:
+		}
+	}
+}
+
+func (f *deploymentFollower) broadcast(event string, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("encoding %s event: %v", event, err)
+		return
+	}
+	f.send([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, body)))
+}
+
+func (f *deploymentFollower) closeSubscribers() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, ch := range f.subs {
+		close(ch)
+		delete(f.subs, id)
+	}
+}
+
+func (f *deploymentFollower) run() {
+	s := f.server
+	ctx := context.Background()
+
+	var repository string
+	if template, ok := s.templateForSite(f.site); ok {
+		repository = template.Repository
+	}
+
+	var ghDeploymentID int64
+	if s.github != nil && f.commitSHA != "" {
+		id, err := s.github.createDeployment(ctx, repository, f.commitSHA, f.site)
+		if err != nil {
+			log.Printf("creating GitHub deployment: %v", err)
+		} else {
+			ghDeploymentID = id
+			if err := s.github.setStatus(ctx, repository, ghDeploymentID, "pending", ""); err != nil {
+				log.Printf("reporting GitHub deployment status: %v", err)
+			}
+		}
+	}
+	reportedInProgress := false
+
+	poll := time.NewTicker(2 * time.Second)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(15 * time.Second)
+	defer heartbeat.Stop()
+
+	var logToken string
+	var reportedUpdates int
+	for {
+		select {
+		case <-heartbeat.C:
+			f.send([]byte(": heartbeat\n\n"))
+
+		case <-poll.C:
+			updates, err := s.getDeploymentUpdates(ctx, f.site, f.deploymentID)
+			if err != nil {
+				log.Printf("polling deployment updates: %v", err)
+				continue
+			}
+			// The updates endpoint returns the deployment's full history on
+			// every call rather than paging like the logs endpoint does, so
+			// only broadcast the ones appended since the last poll.
+			var newUpdates []resourceUpdate
+			if reportedUpdates < len(updates) {
+				newUpdates = updates[reportedUpdates:]
+			}
+			reportedUpdates = len(updates)
+			if len(newUpdates) > 0 && !reportedInProgress && ghDeploymentID != 0 {
+				if err := s.github.setStatus(ctx, repository, ghDeploymentID, "in_progress", ""); err != nil {
+					log.Printf("reporting GitHub deployment status: %v", err)
+				}
+				reportedInProgress = true
+			}
+			for _, u := range newUpdates {
+				f.broadcast("resource", u)
+			}
+
+			logs, nextToken, err := s.getDeploymentLogs(ctx, f.site, f.deploymentID, logToken)
+			if err != nil {
+				log.Printf("polling deployment logs: %v", err)
+				continue
+			}
+			logToken = nextToken
+			for _, l := range logs {
+				f.broadcast("log", l)
+			}
+
+			status, err := s.getDeploymentStatus(ctx, f.site, f.deploymentID)
+			if err != nil {
+				log.Printf("polling deployment status: %v", err)
+				continue
+			}
+			if status != "succeeded" && status != "failed" {
+				continue
+			}
+
+			if ghDeploymentID != 0 {
+				state, environmentURL := "failure", ""
+				if status == "succeeded" {
+					state = "success"
+					if url, err := s.websiteURL(ctx, f.site); err != nil {
+						log.Printf("getting website url: %v", err)
+					} else {
+						environmentURL = url
+					}
+				}
+				if err := s.github.setStatus(ctx, repository, ghDeploymentID, state, environmentURL); err != nil {
+					log.Printf("reporting GitHub deployment status: %v", err)
+				}
+			}
+
+			f.broadcast("complete", deploymentStatusResponse{Status: status})
+			f.closeSubscribers()
+			s.removeFollower(f.site, f)
+			return
+		}
+	}
+}
+
+func (s *siteServer) getDeploymentUpdates(ctx context.Context, stack, deploymentID string) ([]resourceUpdate, error) {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		Get(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployments", deploymentID, "updates"))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		return nil, err
+	}
+	var body deploymentUpdatesResponse
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return nil, fmt.Errorf("decoding updates: %w", err)
+	}
+	return body.Updates, nil
+}
+
+func (s *siteServer) getDeploymentLogs(ctx context.Context, stack, deploymentID, afterToken string) ([]logLine, string, error) {
+	req := s.client.R().SetContext(ctx)
+	if afterToken != "" {
+		req.SetQueryParam("continuationToken", afterToken)
+	}
+	resp, err := req.Get(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployments", deploymentID, "logs"))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		return nil, "", err
+	}
+	var body deploymentLogsResponse
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return nil, "", fmt.Errorf("decoding logs: %w", err)
+	}
+	return body.Lines, body.NextToken, nil
+}
+
+func (s *siteServer) getDeploymentStatus(ctx context.Context, stack, deploymentID string) (string, error) {
+	resp, err := s.client.R().
+		SetContext(ctx).
+		Get(pulumiURL + path.Join("/preview", s.org, s.project, stack, "deployments", deploymentID))
+	if err != nil {
+		return "", err
+	}
+	if err := s.client.checkStatus(resp, 200); err != nil {
+		return "", err
+	}
+	var body deploymentStatusResponse
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return "", fmt.Errorf("decoding deployment status: %w", err)
+	}
+	return body.Status, nil
+}
+
 func main() {
-	repository := flag.String("repo", "", "the GitHub repository that contains the site's Pulumi program")
-	branch := flag.String("branch", "main", "the git branch that contains the site's Pulumi program")
-	dir := flag.String("dir", "", "the subdirectory of the git repository that contains the site's Pulumi program")
-	roleARN := flag.String("role-arn", "", "the AWS IAM Role ARN to use for OIDC integration")
-	sessionName := flag.String("session-name", "site-deploy", "the session name to use for AWS OIDC integration")
+	templatesFile := flag.String("templates-file", "templates.json", "the file used to persist the registered site templates; leave empty to keep templates in memory only")
+	sitesFile := flag.String("sites-file", "sites.json", "the file used to persist which template each site was created from; leave empty to keep the mapping in memory only")
+
 	apiToken := flag.String("token", "", "the Pulumi API token to use")
 	org := flag.String("org", "", "the Pulumi organization to use")
 	project := flag.String("project", "", "the Pulumi project to deploy")
+	githubToken := flag.String("github-token", "", "a GitHub token used to report deployment status via the GitHub Deployments API")
+	adminToken := flag.String("admin-token", "", "a shared secret required as a Bearer token to register site templates")
 	addr := flag.String("addr", ":8080", "the address to listen on")
 	flag.Parse()
 
-	if *repository == "" {
-		log.Fatal("the -repo flag is required")
-	}
-	if *roleARN == "" {
-		log.Fatal("the -role-arn flag is required")
-	}
 	if *apiToken == "" {
 		log.Fatal("the -token flag is required")
 	}
 	if *project == "" {
 		log.Fatal("the -project flag is required")
 	}
+	if *adminToken == "" {
+		log.Fatal("the -admin-token flag is required")
+	}
 
-	client := resty.New()
+	templates, err := newTemplateStore(*templatesFile)
+	if err != nil {
+		log.Fatalf("loading %s: %v", *templatesFile, err)
+	}
+
+	sites, err := newSiteStore(*sitesFile)
+	if err != nil {
+		log.Fatalf("loading %s: %v", *sitesFile, err)
+	}
+
+	client := newPulumiClient(*apiToken)
 
 	if *org == "" {
 		defaultOrg, err := func() (string, error) {
-			resp, err := client.R().
-				SetHeader("Authorization", "token "+*apiToken).
-				SetHeader("Accept", "application/json").
-				SetDoNotParseResponse(true).
-				Get(pulumiURL + "/user")
+			resp, err := client.R().Get(pulumiURL + "/user")
 			if err != nil {
 				return "", err
 			}
-			if resp.StatusCode() != 200 {
-				return "", fmt.Errorf("%v: %v", resp.StatusCode(), (string(resp.Body())))
+			if err := client.checkStatus(resp, 200); err != nil {
+				return "", err
 			}
-			defer resp.RawBody().Close()
 
 			var body getUserResponse
-			if err := json.NewDecoder(resp.RawBody()).Decode(&body); err != nil {
+			if err := json.Unmarshal(resp.Body(), &body); err != nil {
 				return "", fmt.Errorf("decoding response: %w", err)
 			}
 			return body.Organizations[0].GitHubLogin, nil
@@ -415,22 +1407,30 @@ func main() {
 		*org = defaultOrg
 	}
 
+	var github *githubReporter
+	if *githubToken != "" {
+		github = newGitHubReporter(*githubToken)
+	}
+
 	server := &siteServer{
-		client:      client,
-		repository:  *repository,
-		branch:      *branch,
-		dir:         *dir,
-		roleARN:     *roleARN,
-		sessionName: *sessionName,
-		apiToken:    *apiToken,
-		org:         *org,
-		project:     *project,
+		client:    client,
+		templates: templates,
+		github:    github,
+		org:       *org,
+		project:   *project,
+		sites:     sites,
+		followers: make(map[string]*deploymentFollower),
 	}
 	router := httprouter.New()
+	router.POST("/templates", requireAdminToken(*adminToken, server.createTemplate))
 	router.POST("/sites", server.create)
 	router.GET("/sites/:id", server.get)
 	router.POST("/sites/:id", server.update)
 	router.DELETE("/sites/:id", server.delete)
+	router.GET("/sites/:id/events", server.events)
+	router.POST("/sites/:id/previews", server.createPreview)
+	router.GET("/sites/:id/previews/:pr", server.getPreview)
+	router.DELETE("/sites/:id/previews/:pr", server.deletePreview)
 
 	http.ListenAndServe(*addr, router)
 }